@@ -11,6 +11,9 @@ import (
 
 const (
 	maxNumStreams = int(float32(protocol.MaxStreamsPerConnection) * protocol.MaxStreamsMultiplier)
+
+	// defaultStreamWeight is the weight a stream gets until SetStreamPriority is called on it.
+	defaultStreamWeight = 16
 )
 
 type streamsMap struct {
@@ -20,6 +23,37 @@ type streamsMap struct {
 	newStream   newStreamLambda
 
 	roundRobinIndex int
+
+	// priorityNodes holds the dependency tree used by PriorityIterate. Entry 0 is the virtual
+	// root that every stream depends on until SetStreamPriority says otherwise.
+	priorityNodes map[protocol.StreamID]*streamPriorityNode
+	hasPriorities bool
+
+	nextStreamID      protocol.StreamID
+	localStreamParity protocol.StreamID
+	streamSlotFreed   *sync.Cond
+
+	// acceptQueue is the FIFO of remote streams not yet claimed by AcceptStream; pendingAccept
+	// mirrors its membership so RemoveStream can tell in O(1) whether it has to search the queue.
+	acceptQueue    []protocol.StreamID
+	pendingAccept  map[protocol.StreamID]bool
+	streamAccepted *sync.Cond
+
+	// closeChan is closed, and closeErr set, once the connection goes away.
+	closeChan chan struct{}
+	closeErr  error
+}
+
+// streamPriorityNode is a stream's position in the priority dependency tree maintained
+// alongside openStreams. See SetStreamPriority for how the tree is built and interpreted.
+type streamPriorityNode struct {
+	parentID  protocol.StreamID
+	weight    uint8
+	exclusive bool
+	children  []protocol.StreamID
+
+	// currentWeight is the persisted smooth weighted round-robin credit used by orderSiblings.
+	currentWeight int
 }
 
 type streamLambda func(*stream) (bool, error)
@@ -29,12 +63,37 @@ var (
 	errMapAccess = errors.New("streamsMap: Error accessing the streams map")
 )
 
-func newStreamsMap(newStream newStreamLambda) *streamsMap {
-	return &streamsMap{
-		streams:     map[protocol.StreamID]*stream{},
-		openStreams: make([]protocol.StreamID, 0, maxNumStreams),
-		newStream:   newStream,
+// newStreamsMap creates a new streamsMap. nextStreamID is the ID of the first locally-opened
+// stream; its parity also distinguishes locally- from remotely-initiated streams.
+func newStreamsMap(newStream newStreamLambda, nextStreamID protocol.StreamID) *streamsMap {
+	m := &streamsMap{
+		streams:           map[protocol.StreamID]*stream{},
+		openStreams:       make([]protocol.StreamID, 0, maxNumStreams),
+		newStream:         newStream,
+		priorityNodes:     map[protocol.StreamID]*streamPriorityNode{0: {}},
+		nextStreamID:      nextStreamID,
+		localStreamParity: nextStreamID % 2,
+		acceptQueue:       make([]protocol.StreamID, 0, maxNumStreams),
+		pendingAccept:     map[protocol.StreamID]bool{},
+		closeChan:         make(chan struct{}),
 	}
+	m.streamSlotFreed = sync.NewCond(&m.mutex)
+	m.streamAccepted = sync.NewCond(&m.mutex)
+	return m
+}
+
+// CloseWithError makes current and future OpenStreamSync/AcceptStream calls return err instead
+// of blocking. Idempotent; only the first call's err takes effect.
+func (m *streamsMap) CloseWithError(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closeErr != nil {
+		return
+	}
+	m.closeErr = err
+	close(m.closeChan)
+	m.streamSlotFreed.Broadcast()
+	m.streamAccepted.Broadcast()
 }
 
 // GetOrOpenStream either returns an existing stream, a newly opened stream, or nil if a stream with the provided ID is already closed.
@@ -91,6 +150,12 @@ func (m *streamsMap) RoundRobinIterate(fn streamLambda) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	return m.roundRobinIterateLocked(fn)
+}
+
+// roundRobinIterateLocked is the body of RoundRobinIterate. It's split out so that
+// PriorityIterate can fall back to it without re-acquiring m.mutex.
+func (m *streamsMap) roundRobinIterateLocked(fn streamLambda) error {
 	numStreams := len(m.openStreams)
 	startIndex := m.roundRobinIndex
 
@@ -115,18 +180,250 @@ func (m *streamsMap) RoundRobinIterate(fn streamLambda) error {
 	return nil
 }
 
+// SetStreamPriority makes id depend on parentID (0 for the virtual root) with the given weight;
+// if exclusive is set, parentID's other children are moved to depend on id instead.
+func (m *streamsMap) SetStreamPriority(id, parentID protocol.StreamID, weight uint8, exclusive bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if id == 0 {
+		return fmt.Errorf("cannot set a priority for stream 0")
+	}
+	if id == parentID {
+		return fmt.Errorf("stream %d cannot depend on itself", id)
+	}
+	m.ensurePriorityNode(parentID)
+
+	node, existed := m.priorityNodes[id]
+	if !existed {
+		node = &streamPriorityNode{}
+		m.priorityNodes[id] = node
+	}
+
+	if parentID != 0 && existed && m.isDescendant(id, parentID) {
+		// parentID currently depends (transitively) on id. Detach it and have it take id's old
+		// place in the tree, so that making id depend on parentID below can't create a cycle.
+		oldParentID := node.parentID
+		m.detachFromParent(parentID)
+		m.priorityNodes[parentID].parentID = oldParentID
+		m.priorityNodes[oldParentID].children = append(m.priorityNodes[oldParentID].children, parentID)
+	}
+
+	if existed {
+		m.detachFromParent(id)
+	}
+
+	parentNode := m.priorityNodes[parentID]
+	if exclusive {
+		// id pre-empts its new siblings: they become id's children instead.
+		node.children = append(node.children, parentNode.children...)
+		for _, c := range parentNode.children {
+			m.priorityNodes[c].parentID = id
+		}
+		parentNode.children = nil
+	}
+	parentNode.children = append(parentNode.children, id)
+	node.parentID = parentID
+	node.weight = weight
+	node.exclusive = exclusive
+
+	m.hasPriorities = true
+	return nil
+}
+
+// ensurePriorityNode makes sure id has a node in the priority tree, defaulting to a dependency
+// on the root with the default weight if it doesn't have one yet.
+func (m *streamsMap) ensurePriorityNode(id protocol.StreamID) {
+	if _, ok := m.priorityNodes[id]; !ok {
+		m.priorityNodes[id] = &streamPriorityNode{weight: defaultStreamWeight}
+		m.priorityNodes[0].children = append(m.priorityNodes[0].children, id)
+	}
+}
+
+// isDescendant reports whether candidate is id itself, or appears anywhere in id's subtree.
+func (m *streamsMap) isDescendant(id, candidate protocol.StreamID) bool {
+	if id == candidate {
+		return true
+	}
+	node, ok := m.priorityNodes[id]
+	if !ok {
+		return false
+	}
+	for _, c := range node.children {
+		if m.isDescendant(c, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// detachFromParent removes id from its current parent's children list, without touching id's
+// own parentID field.
+func (m *streamsMap) detachFromParent(id protocol.StreamID) {
+	node, ok := m.priorityNodes[id]
+	if !ok {
+		return
+	}
+	siblings := m.priorityNodes[node.parentID].children
+	for i, c := range siblings {
+		if c == id {
+			m.priorityNodes[node.parentID].children = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+}
+
+// PriorityIterate walks streams parent-before-children, siblings interleaved by weight (see
+// orderSiblings); it falls back to RoundRobinIterate until SetStreamPriority is called at least once.
+func (m *streamsMap) PriorityIterate(fn streamLambda) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.hasPriorities {
+		return m.roundRobinIterateLocked(fn)
+	}
+
+	order := make([]protocol.StreamID, 0, len(m.openStreams))
+	m.appendSubtreeOrder(0, &order)
+
+	for _, streamID := range order {
+		str, ok := m.streams[streamID]
+		if !ok || str == nil {
+			// The node may belong to an ID with no open stream (a parent that was never opened, or
+			// a priority set before the stream was opened or after it was closed); skip it.
+			continue
+		}
+		cont, err := fn(str)
+		if err != nil {
+			return err
+		}
+		if !cont {
+			break
+		}
+	}
+	return nil
+}
+
+// appendSubtreeOrder appends the priority-ordered walk of id's subtree (excluding id itself) to order.
+func (m *streamsMap) appendSubtreeOrder(id protocol.StreamID, order *[]protocol.StreamID) {
+	node, ok := m.priorityNodes[id]
+	if !ok {
+		return
+	}
+	for _, c := range m.orderSiblings(node.children) {
+		*order = append(*order, c)
+		m.appendSubtreeOrder(c, order)
+	}
+}
+
+// orderSiblings orders children by smooth weighted round-robin (nginx-style), so which sibling
+// leads rotates from one call to the next proportionally to weight.
+func (m *streamsMap) orderSiblings(children []protocol.StreamID) []protocol.StreamID {
+	total := 0
+	for _, c := range children {
+		node := m.priorityNodes[c]
+		total += int(node.weight)
+		node.currentWeight += int(node.weight)
+	}
+
+	remaining := make([]protocol.StreamID, len(children))
+	copy(remaining, children)
+	order := make([]protocol.StreamID, 0, len(children))
+
+	for len(remaining) > 0 {
+		best := 0
+		for i, c := range remaining {
+			if m.priorityNodes[c].currentWeight > m.priorityNodes[remaining[best]].currentWeight {
+				best = i
+			}
+		}
+		picked := remaining[best]
+		if len(order) == 0 {
+			// only the leader pays for its turn; the others follow in order of credit
+			m.priorityNodes[picked].currentWeight -= total
+		}
+		order = append(order, picked)
+		remaining = append(remaining[:best], remaining[best+1:]...)
+	}
+	return order
+}
+
 func (m *streamsMap) putStream(s *stream) error {
 	id := s.StreamID()
 	if _, ok := m.streams[id]; ok {
 		return fmt.Errorf("a stream with ID %d already exists", id)
 	}
 
+	// check the accept queue's capacity before touching any state
+	isRemote := id%2 != m.localStreamParity
+	if isRemote && len(m.acceptQueue) == maxNumStreams {
+		return qerr.TooManyOpenStreams
+	}
+
 	m.streams[id] = s
 	m.openStreams = append(m.openStreams, id)
+	// give the stream a place in the priority tree even if it never gets an explicit priority
+	m.ensurePriorityNode(id)
+
+	if isRemote {
+		m.acceptQueue = append(m.acceptQueue, id)
+		m.pendingAccept[id] = true
+		m.streamAccepted.Signal()
+	}
 
 	return nil
 }
 
+// OpenStreamSync opens a new locally-initiated stream, blocking until a slot is free or the
+// connection is closed.
+func (m *streamsMap) OpenStreamSync() (*stream, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for len(m.openStreams) >= maxNumStreams {
+		if m.closeErr != nil {
+			return nil, m.closeErr
+		}
+		m.streamSlotFreed.Wait()
+	}
+	if m.closeErr != nil {
+		return nil, m.closeErr
+	}
+
+	id := m.nextStreamID
+	s, err := m.newStream(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.putStream(s); err != nil {
+		return nil, err
+	}
+	m.nextStreamID += 2
+	return s, nil
+}
+
+// AcceptStream returns the next peer-initiated stream, blocking until one becomes available or
+// the connection is closed.
+func (m *streamsMap) AcceptStream() (*stream, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for len(m.acceptQueue) == 0 {
+		if m.closeErr != nil {
+			return nil, m.closeErr
+		}
+		m.streamAccepted.Wait()
+	}
+	if m.closeErr != nil {
+		return nil, m.closeErr
+	}
+
+	id := m.acceptQueue[0]
+	m.acceptQueue = m.acceptQueue[1:]
+	delete(m.pendingAccept, id)
+	return m.streams[id], nil
+}
+
 // Attention: this function must only be called if a mutex has been acquired previously
 func (m *streamsMap) RemoveStream(id protocol.StreamID) error {
 	s, ok := m.streams[id]
@@ -148,13 +445,57 @@ func (m *streamsMap) RemoveStream(id protocol.StreamID) error {
 		}
 	}
 
+	m.removePriorityNode(id)
+
+	if m.pendingAccept[id] {
+		delete(m.pendingAccept, id)
+		for i, queuedID := range m.acceptQueue {
+			if queuedID == id {
+				m.acceptQueue = append(m.acceptQueue[:i], m.acceptQueue[i+1:]...)
+				break
+			}
+		}
+	}
+
+	// a slot just freed up: wake one blocked OpenStreamSync call, if any
+	m.streamSlotFreed.Signal()
+
 	return nil
 }
 
+// removePriorityNode removes id from the priority tree, reparenting its children onto id's
+// former parent with HTTP/2-style (RFC 7540 section 5.3.4) weight rescaling.
+func (m *streamsMap) removePriorityNode(id protocol.StreamID) {
+	node, ok := m.priorityNodes[id]
+	if !ok {
+		return
+	}
+	m.detachFromParent(id)
+	parentNode := m.priorityNodes[node.parentID]
+
+	childWeightSum := 0
+	for _, c := range node.children {
+		childWeightSum += int(m.priorityNodes[c].weight)
+	}
+	for _, c := range node.children {
+		child := m.priorityNodes[c]
+		if childWeightSum > 0 {
+			newWeight := (int(node.weight)*int(child.weight) + childWeightSum/2) / childWeightSum
+			if newWeight > 255 {
+				newWeight = 255
+			}
+			child.weight = uint8(newWeight)
+		}
+		child.parentID = node.parentID
+		parentNode.children = append(parentNode.children, c)
+	}
+	delete(m.priorityNodes, id)
+}
+
 // NumberOfStreams gets the number of open streams
 func (m *streamsMap) NumberOfStreams() int {
 	m.mutex.RLock()
 	n := len(m.openStreams)
 	m.mutex.RUnlock()
 	return n
-}
\ No newline at end of file
+}
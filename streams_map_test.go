@@ -0,0 +1,156 @@
+package quic
+
+import (
+	"errors"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Streams Map", func() {
+	var m *streamsMap
+
+	newMockStream := func(id protocol.StreamID) (*stream, error) {
+		return &stream{streamID: id}, nil
+	}
+
+	BeforeEach(func() {
+		m = newStreamsMap(newMockStream, 1)
+	})
+
+	Context("priority scheduling", func() {
+		It("interleaves siblings proportionally to weight", func() {
+			for i := protocol.StreamID(1); i <= 5; i += 2 {
+				s, err := m.newStream(i)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(m.putStream(s)).To(Succeed())
+			}
+			Expect(m.SetStreamPriority(1, 0, 30, false)).To(Succeed())
+			Expect(m.SetStreamPriority(3, 0, 10, false)).To(Succeed())
+			Expect(m.SetStreamPriority(5, 0, 10, false)).To(Succeed())
+
+			counts := map[protocol.StreamID]int{}
+			const rounds = 50
+			for i := 0; i < rounds; i++ {
+				// every walk visits all three streams, so count only the one that leads it
+				err := m.PriorityIterate(func(s *stream) (bool, error) {
+					counts[s.StreamID()]++
+					return false, nil
+				})
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			// weight 30 vs 10 vs 10 should land close to a 3:1:1 share of the lead position
+			Expect(float64(counts[1])).To(BeNumerically("~", 3*float64(counts[3]), 1))
+			Expect(counts[3]).To(Equal(counts[5]))
+		})
+
+		It("rescales a removed node's children to preserve its share", func() {
+			for i := protocol.StreamID(1); i <= 7; i += 2 {
+				s, err := m.newStream(i)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(m.putStream(s)).To(Succeed())
+			}
+			Expect(m.SetStreamPriority(3, 0, 32, false)).To(Succeed())
+			Expect(m.SetStreamPriority(5, 0, 32, false)).To(Succeed())
+			Expect(m.SetStreamPriority(1, 3, 10, false)).To(Succeed())
+			Expect(m.SetStreamPriority(7, 3, 10, false)).To(Succeed())
+
+			Expect(m.RemoveStream(3)).To(Succeed())
+
+			node1 := m.priorityNodes[1]
+			node7 := m.priorityNodes[7]
+			Expect(node1.parentID).To(Equal(protocol.StreamID(0)))
+			Expect(node7.parentID).To(Equal(protocol.StreamID(0)))
+			// 1 and 7 split node 3's former weight (32) in proportion to their own weights
+			// (10:10), so their combined share against sibling 5 stays 1:1
+			Expect(node1.weight).To(Equal(uint8(16)))
+			Expect(node7.weight).To(Equal(uint8(16)))
+		})
+	})
+
+	Context("blocking OpenStreamSync and AcceptStream", func() {
+		fillOpenStreams := func() {
+			for len(m.openStreams) < maxNumStreams {
+				s, err := m.newStream(m.nextStreamID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(m.putStream(s)).To(Succeed())
+				m.nextStreamID += 2
+			}
+		}
+
+		It("OpenStreamSync blocks until a slot is freed", func() {
+			fillOpenStreams()
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				_, err := m.OpenStreamSync()
+				Expect(err).ToNot(HaveOccurred())
+				close(done)
+			}()
+
+			Consistently(done).ShouldNot(BeClosed())
+			Expect(m.RemoveStream(1)).To(Succeed())
+			Eventually(done).Should(BeClosed())
+		})
+
+		It("OpenStreamSync unblocks with an error once the connection is closed", func() {
+			fillOpenStreams()
+			errChan := make(chan error)
+			go func() {
+				defer GinkgoRecover()
+				_, err := m.OpenStreamSync()
+				errChan <- err
+			}()
+
+			Consistently(errChan).ShouldNot(Receive())
+			testErr := errors.New("test error")
+			m.CloseWithError(testErr)
+			Eventually(errChan).Should(Receive(Equal(testErr)))
+		})
+
+		It("AcceptStream blocks until a remote stream is available", func() {
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				s, err := m.AcceptStream()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(s.StreamID()).To(Equal(protocol.StreamID(2)))
+				close(done)
+			}()
+
+			Consistently(done).ShouldNot(BeClosed())
+			s, err := m.newStream(2)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m.putStream(s)).To(Succeed())
+			Eventually(done).Should(BeClosed())
+		})
+
+		It("AcceptStream unblocks with an error once the connection is closed", func() {
+			errChan := make(chan error)
+			go func() {
+				defer GinkgoRecover()
+				_, err := m.AcceptStream()
+				errChan <- err
+			}()
+
+			Consistently(errChan).ShouldNot(Receive())
+			testErr := errors.New("test error")
+			m.CloseWithError(testErr)
+			Eventually(errChan).Should(Receive(Equal(testErr)))
+		})
+
+		It("reclaims a not-yet-accepted stream's slot in the accept queue", func() {
+			s, err := m.newStream(2)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m.putStream(s)).To(Succeed())
+			Expect(m.acceptQueue).To(ContainElement(protocol.StreamID(2)))
+
+			Expect(m.RemoveStream(2)).To(Succeed())
+			Expect(m.acceptQueue).ToNot(ContainElement(protocol.StreamID(2)))
+			Expect(m.pendingAccept).ToNot(HaveKey(protocol.StreamID(2)))
+		})
+	})
+})